@@ -0,0 +1,446 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.uber.internal/devexp/minions/common/persistence"
+	"code.uber.internal/devexp/minions/common/service"
+	"code.uber.internal/devexp/minions/service/frontend"
+	"code.uber.internal/devexp/minions/service/history"
+	"code.uber.internal/devexp/minions/service/matching"
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber-common/bark"
+	"github.com/uber-go/tally"
+	tchannel "github.com/uber/tchannel-go"
+	"github.com/uber/tchannel-go/thrift"
+	"golang.org/x/sync/errgroup"
+)
+
+// ClusterOptions configures a multi-node in-process cluster created by
+// NewCadenceCluster.
+type ClusterOptions struct {
+	ShardMgr              persistence.ShardManager
+	ExecutionMgrFactory   persistence.ExecutionManagerFactory
+	TaskMgr               persistence.TaskManager
+	NumberOfHistoryShards int
+	NumberOfHistoryNodes  int
+	NumberOfMatchingNodes int
+	Logger                bark.Logger
+	FrontendAddress       string
+	Tracer                opentracing.Tracer
+	MetricsOptions        MetricsOptions
+	// RingpopReadyTimeout bounds how long Start() and RestartNode() wait for
+	// the ringpop ring to converge before failing. Zero or negative uses
+	// defaultRingpopReadyTimeout.
+	RingpopReadyTimeout time.Duration
+}
+
+// Cluster is a Cadence host backed by multiple history and matching nodes
+// joined on a single ringpop ring, on top of the usual single frontend. It
+// lets tests exercise shard ownership transfer, task list forwarding and
+// ringpop rebalancing by killing and restarting individual nodes.
+type Cluster interface {
+	Cadence
+	HistoryNodes() []string
+	MatchingNodes() []string
+	KillNode(addr string) error
+	RestartNode(addr string) error
+}
+
+// clusterNode is a single history or matching instance hosted inside a
+// Cluster. Exactly one of historyHandler/matchingHandler is set, depending
+// on which kind of node it is.
+type clusterNode struct {
+	name            string
+	listenAddress   string
+	channel         *tchannel.Channel
+	cancel          context.CancelFunc
+	historyHandler  *history.Handler
+	matchingHandler *matching.Handler
+}
+
+func (n *clusterNode) address() string {
+	return n.channel.PeerInfo().HostPort
+}
+
+type cadenceClusterImpl struct {
+	opts ClusterOptions
+
+	frontendHandler       *frontend.WorkflowHandler
+	frontendChannel       *tchannel.Channel
+	frontendListenAddress string
+
+	mu            sync.Mutex
+	historyNodes  []*clusterNode
+	matchingNodes []*clusterNode
+	rpHosts       []string
+
+	metricsScope  tally.Scope
+	metricsCloser io.Closer
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	errGroup *errgroup.Group
+}
+
+// NewCadenceCluster returns a Cluster that hosts opts.NumberOfHistoryNodes
+// history nodes and opts.NumberOfMatchingNodes matching nodes, all joined on
+// a single ringpop ring, plus one frontend.
+func NewCadenceCluster(opts ClusterOptions) Cluster {
+	opts.Tracer = defaultTracer(opts.Tracer)
+	return &cadenceClusterImpl{
+		opts:                  opts,
+		frontendListenAddress: opts.FrontendAddress,
+	}
+}
+
+func (c *cadenceClusterImpl) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	c.ctx = ctx
+	c.cancel = cancel
+	g, gctx := errgroup.WithContext(ctx)
+	c.errGroup = g
+	go func() {
+		if err := g.Wait(); err != nil {
+			c.opts.Logger.WithField("error", err).Error("cadence cluster node exited with error")
+		}
+	}()
+
+	c.metricsScope, c.metricsCloser = buildMetricsScope(ctx, c.opts.MetricsOptions, c.opts.Logger)
+
+	var err error
+	if c.frontendChannel, err = listenTChannel(frontendServiceName, c.frontendListenAddress, c.opts.Tracer); err != nil {
+		return err
+	}
+
+	for i := 0; i < c.opts.NumberOfHistoryNodes; i++ {
+		node, err := c.newNode(fmt.Sprintf("cadence-history-%d", i))
+		if err != nil {
+			return err
+		}
+		c.historyNodes = append(c.historyNodes, node)
+	}
+	for i := 0; i < c.opts.NumberOfMatchingNodes; i++ {
+		node, err := c.newNode(fmt.Sprintf("cadence-matching-%d", i))
+		if err != nil {
+			return err
+		}
+		c.matchingNodes = append(c.matchingNodes, node)
+	}
+
+	c.rpHosts = append(c.rpHosts, c.FrontendAddress())
+	for _, node := range c.historyNodes {
+		c.rpHosts = append(c.rpHosts, node.address())
+	}
+	for _, node := range c.matchingNodes {
+		c.rpHosts = append(c.rpHosts, node.address())
+	}
+
+	total := len(c.historyNodes) + len(c.matchingNodes) + 1
+	readyCh := make(chan struct{}, total)
+
+	var startWG sync.WaitGroup
+	startWG.Add(len(c.historyNodes) + len(c.matchingNodes))
+	for _, node := range c.historyNodes {
+		node := node
+		g.Go(func() error { return c.runHistoryNode(gctx, node, &startWG, readyCh) })
+	}
+	for _, node := range c.matchingNodes {
+		node := node
+		g.Go(func() error { return c.runMatchingNode(gctx, node, &startWG, readyCh) })
+	}
+	startWG.Wait()
+	if gctx.Err() != nil {
+		return g.Wait()
+	}
+
+	startWG.Add(1)
+	g.Go(func() error { return c.runFrontend(gctx, &startWG, readyCh) })
+	startWG.Wait()
+	if gctx.Err() != nil {
+		return g.Wait()
+	}
+
+	if err := waitForRingpopReady(readyCh, total, c.opts.RingpopReadyTimeout); err != nil {
+		cancel()
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops the frontend first so no new requests are accepted, then
+// matching, then history, cancels the nodes' context so in-flight requests
+// can drain and their tchannels close, and waits for that to finish up to
+// ctx's deadline.
+func (c *cadenceClusterImpl) Shutdown(ctx context.Context) error {
+	c.frontendHandler.Stop()
+	c.mu.Lock()
+	for _, node := range c.matchingNodes {
+		node.matchingHandler.Stop()
+	}
+	for _, node := range c.historyNodes {
+		node.historyHandler.Stop()
+	}
+	c.mu.Unlock()
+	c.cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- c.errGroup.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	closeTracer(c.opts.Tracer, c.opts.Logger)
+	if mErr := c.metricsCloser.Close(); mErr != nil {
+		c.opts.Logger.WithField("error", mErr).Warn("failed to close metrics reporter")
+	}
+	return err
+}
+
+// Stop shuts the cluster down with no deadline. Use Shutdown directly for
+// bounded draining.
+func (c *cadenceClusterImpl) Stop() {
+	if err := c.Shutdown(context.Background()); err != nil {
+		c.opts.Logger.WithField("error", err).Error("error during shutdown")
+	}
+}
+
+// InstallSignalHandler wires SIGINT/SIGTERM to Shutdown, giving gracePeriod
+// to drain in-flight requests before forcing a return. It is meant to be
+// called once, typically right after Start.
+func (c *cadenceClusterImpl) InstallSignalHandler(gracePeriod time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		c.opts.Logger.WithField("signal", sig).Info("received shutdown signal")
+		ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+		if err := c.Shutdown(ctx); err != nil {
+			c.opts.Logger.WithField("error", err).Error("graceful shutdown did not complete within grace period")
+		}
+	}()
+}
+
+func (c *cadenceClusterImpl) FrontendAddress() string {
+	return c.frontendChannel.PeerInfo().HostPort
+}
+
+// HistoryServiceAddress returns the address of the first history node, for
+// callers that only care about a single representative address, or "" if the
+// cluster has no history nodes (ClusterOptions.NumberOfHistoryNodes: 0).
+func (c *cadenceClusterImpl) HistoryServiceAddress() string {
+	nodes := c.HistoryNodes()
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[0]
+}
+
+// MatchingServiceAddress returns the address of the first matching node, for
+// callers that only care about a single representative address, or "" if the
+// cluster has no matching nodes (ClusterOptions.NumberOfMatchingNodes: 0).
+func (c *cadenceClusterImpl) MatchingServiceAddress() string {
+	nodes := c.MatchingNodes()
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[0]
+}
+
+// HistoryNodes returns the bound address of every history node in the cluster.
+func (c *cadenceClusterImpl) HistoryNodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addrs := make([]string, 0, len(c.historyNodes))
+	for _, node := range c.historyNodes {
+		addrs = append(addrs, node.address())
+	}
+	return addrs
+}
+
+// MatchingNodes returns the bound address of every matching node in the cluster.
+func (c *cadenceClusterImpl) MatchingNodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addrs := make([]string, 0, len(c.matchingNodes))
+	for _, node := range c.matchingNodes {
+		addrs = append(addrs, node.address())
+	}
+	return addrs
+}
+
+// KillNode shuts down the node listening on addr without restarting it,
+// simulating a node failure so tests can verify shards and task lists get
+// reassigned to the remaining nodes.
+func (c *cadenceClusterImpl) KillNode(addr string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node, _ := c.findNodeLocked(addr)
+	if node == nil {
+		return fmt.Errorf("host: no cluster node listening on %v", addr)
+	}
+	node.cancel()
+	return nil
+}
+
+// RestartNode kills the node listening on addr and starts a fresh instance
+// of the same kind in its place, rejoining the existing ring.
+func (c *cadenceClusterImpl) RestartNode(addr string) error {
+	c.mu.Lock()
+	node, isHistory := c.findNodeLocked(addr)
+	c.mu.Unlock()
+	if node == nil {
+		return fmt.Errorf("host: no cluster node listening on %v", addr)
+	}
+	node.cancel()
+
+	replacement, err := c.newNode(node.name)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if isHistory {
+		c.replaceNodeLocked(c.historyNodes, node, replacement)
+	} else {
+		c.replaceNodeLocked(c.matchingNodes, node, replacement)
+	}
+	// The seed list handed to every service is built once from the addresses
+	// bound at Start/RestartNode time; since the replacement binds a fresh
+	// ":0" port, replace the dead node's address here too so later restarts
+	// (and any node that re-reads the seed list) don't keep seeding from an
+	// address nothing is listening on anymore.
+	for i, host := range c.rpHosts {
+		if host == node.address() {
+			c.rpHosts[i] = replacement.address()
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	readyCh := make(chan struct{}, 1)
+	var startWG sync.WaitGroup
+	startWG.Add(1)
+	if isHistory {
+		c.errGroup.Go(func() error { return c.runHistoryNode(c.ctx, replacement, &startWG, readyCh) })
+	} else {
+		c.errGroup.Go(func() error { return c.runMatchingNode(c.ctx, replacement, &startWG, readyCh) })
+	}
+	startWG.Wait()
+	return waitForRingpopReady(readyCh, 1, c.opts.RingpopReadyTimeout)
+}
+
+// currentRPHosts returns a snapshot of the ringpop seed list, safe to call
+// while RestartNode may be concurrently updating it.
+func (c *cadenceClusterImpl) currentRPHosts() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hosts := make([]string, len(c.rpHosts))
+	copy(hosts, c.rpHosts)
+	return hosts
+}
+
+func (c *cadenceClusterImpl) findNodeLocked(addr string) (node *clusterNode, isHistory bool) {
+	for _, n := range c.historyNodes {
+		if n.address() == addr {
+			return n, true
+		}
+	}
+	for _, n := range c.matchingNodes {
+		if n.address() == addr {
+			return n, false
+		}
+	}
+	return nil, false
+}
+
+func (c *cadenceClusterImpl) replaceNodeLocked(nodes []*clusterNode, old, replacement *clusterNode) {
+	for i, n := range nodes {
+		if n == old {
+			nodes[i] = replacement
+			return
+		}
+	}
+}
+
+func (c *cadenceClusterImpl) newNode(name string) (*clusterNode, error) {
+	ch, err := listenTChannel(name, ":0", c.opts.Tracer)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterNode{name: name, listenAddress: ":0", channel: ch}, nil
+}
+
+func (c *cadenceClusterImpl) runHistoryNode(ctx context.Context, node *clusterNode, startWG *sync.WaitGroup,
+	readyCh chan<- struct{}) error {
+	nodeCtx, cancel := context.WithCancel(ctx)
+	node.cancel = cancel
+	tchanFactory := func(sName string, thriftServices []thrift.TChanServer) (*tchannel.Channel, *thrift.Server) {
+		return attachThriftServices(node.channel, thriftServices)
+	}
+	scope := scopeForService(c.metricsScope, node.name)
+	rpHosts := c.currentRPHosts()
+	svc := service.New(node.name, c.opts.Logger.WithField("service", node.name), scope, tchanFactory,
+		rpHosts, c.opts.NumberOfHistoryShards, c.opts.Tracer)
+	go notifyOnRingpopReady(nodeCtx, svc.GetRingpop().GetReachableMembers, rpHosts, readyCh)
+	var thriftServices []thrift.TChanServer
+	node.historyHandler, thriftServices = history.NewHandler(svc, c.opts.ShardMgr, c.opts.ExecutionMgrFactory,
+		c.opts.NumberOfHistoryShards, false)
+	node.historyHandler.Start(thriftServices)
+	startWG.Done()
+	<-nodeCtx.Done()
+	return node.channel.Close()
+}
+
+func (c *cadenceClusterImpl) runMatchingNode(ctx context.Context, node *clusterNode, startWG *sync.WaitGroup,
+	readyCh chan<- struct{}) error {
+	nodeCtx, cancel := context.WithCancel(ctx)
+	node.cancel = cancel
+	tchanFactory := func(sName string, thriftServices []thrift.TChanServer) (*tchannel.Channel, *thrift.Server) {
+		return attachThriftServices(node.channel, thriftServices)
+	}
+	scope := scopeForService(c.metricsScope, node.name)
+	rpHosts := c.currentRPHosts()
+	svc := service.New(node.name, c.opts.Logger.WithField("service", node.name), scope, tchanFactory,
+		rpHosts, c.opts.NumberOfHistoryShards, c.opts.Tracer)
+	go notifyOnRingpopReady(nodeCtx, svc.GetRingpop().GetReachableMembers, rpHosts, readyCh)
+	var thriftServices []thrift.TChanServer
+	node.matchingHandler, thriftServices = matching.NewHandler(c.opts.TaskMgr, svc)
+	node.matchingHandler.Start(thriftServices)
+	startWG.Done()
+	<-nodeCtx.Done()
+	return node.channel.Close()
+}
+
+func (c *cadenceClusterImpl) runFrontend(ctx context.Context, startWG *sync.WaitGroup, readyCh chan<- struct{}) error {
+	tchanFactory := func(sName string, thriftServices []thrift.TChanServer) (*tchannel.Channel, *thrift.Server) {
+		return attachThriftServices(c.frontendChannel, thriftServices)
+	}
+	scope := scopeForService(c.metricsScope, frontendServiceName)
+	rpHosts := c.currentRPHosts()
+	svc := service.New(frontendServiceName, c.opts.Logger.WithField("service", frontendServiceName), scope,
+		tchanFactory, rpHosts, c.opts.NumberOfHistoryShards, c.opts.Tracer)
+	go notifyOnRingpopReady(ctx, svc.GetRingpop().GetReachableMembers, rpHosts, readyCh)
+	var thriftServices []thrift.TChanServer
+	c.frontendHandler, thriftServices = frontend.NewWorkflowHandler(svc)
+	if err := c.frontendHandler.Start(thriftServices); err != nil {
+		c.cancel()
+		startWG.Done()
+		return err
+	}
+	startWG.Done()
+	<-ctx.Done()
+	return c.frontendChannel.Close()
+}
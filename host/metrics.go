@@ -0,0 +1,112 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/uber-common/bark"
+	"github.com/uber-go/tally"
+	"github.com/uber-go/tally/prometheus"
+	promclient "github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultRuntimeMetricsInterval is how often goroutine count and GC pause
+// are sampled when MetricsOptions.ReportInterval is unset.
+const defaultRuntimeMetricsInterval = time.Second
+
+// MetricsOptions configures how the hosted services report metrics.
+//
+// If Scope is set it is used as-is and ReporterHTTPPort is ignored. If Scope
+// is unset and ReporterHTTPPort is non-zero, a Prometheus-backed root scope
+// is created and served on that port at /metrics. If neither is set, metrics
+// are discarded via tally.NoopScope, matching the previous tally.NewTestScope
+// behavior.
+type MetricsOptions struct {
+	Scope            tally.Scope
+	ReporterHTTPPort int
+	ReportInterval   time.Duration
+}
+
+// buildMetricsScope resolves mo into a root tally.Scope and a closer to call
+// on shutdown, then begins reporting goroutine count and GC pause under the
+// "runtime." prefix until ctx is cancelled, regardless of which scope it
+// resolved to — including a caller-supplied mo.Scope, so benchmark runs that
+// bring their own scope still get the runtime gauges.
+func buildMetricsScope(ctx context.Context, mo MetricsOptions, logger bark.Logger) (tally.Scope, io.Closer) {
+	scope, closer := resolveMetricsScope(ctx, mo, logger)
+	reportRuntimeMetrics(ctx, scope.SubScope("runtime"), mo.ReportInterval)
+	return scope, closer
+}
+
+// resolveMetricsScope implements the Scope/ReporterHTTPPort precedence
+// documented on MetricsOptions, without regard to runtime metric reporting.
+func resolveMetricsScope(ctx context.Context, mo MetricsOptions, logger bark.Logger) (tally.Scope, io.Closer) {
+	if mo.Scope != nil {
+		return mo.Scope, ioutil.NopCloser(nil)
+	}
+	if mo.ReporterHTTPPort == 0 {
+		return tally.NoopScope, ioutil.NopCloser(nil)
+	}
+
+	// Each instance gets its own Prometheus registry; the default global
+	// registry is shared process-wide and two instances reporting in the
+	// same process (as tests that spin up multiple Cadence/Cluster hosts do)
+	// would panic on duplicate metric registration.
+	reporter := prometheus.NewReporter(prometheus.Options{Registerer: promclient.NewRegistry()})
+	scope, closer := tally.NewRootScope(tally.ScopeOptions{Reporter: reporter}, time.Second)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reporter.HTTPHandler())
+	addr := fmt.Sprintf(":%d", mo.ReporterHTTPPort)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.WithField("error", err).Error("metrics HTTP server stopped unexpectedly")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	return scope, closer
+}
+
+// reportRuntimeMetrics samples runtime.NumGoroutine and the most recent GC
+// pause every interval (defaultRuntimeMetricsInterval if interval <= 0),
+// until ctx is cancelled.
+func reportRuntimeMetrics(ctx context.Context, scope tally.Scope, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultRuntimeMetricsInterval
+	}
+	goroutines := scope.Gauge("goroutines")
+	gcPauseMs := scope.Gauge("gc_pause_ms")
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var memStats runtime.MemStats
+		for {
+			select {
+			case <-ticker.C:
+				goroutines.Update(float64(runtime.NumGoroutine()))
+				runtime.ReadMemStats(&memStats)
+				lastPause := memStats.PauseNs[(memStats.NumGC+255)%256]
+				gcPauseMs.Update(float64(lastPause) / float64(time.Millisecond))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// scopeForService returns scope tagged with the hosted service's name, so
+// metrics from different services sharing a root scope stay distinguishable.
+func scopeForService(scope tally.Scope, serviceName string) tally.Scope {
+	return scope.Tagged(map[string]string{"service": serviceName})
+}
@@ -1,7 +1,13 @@
 package host
 
 import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"code.uber.internal/devexp/minions/common/persistence"
@@ -9,16 +15,41 @@ import (
 	"code.uber.internal/devexp/minions/service/frontend"
 	"code.uber.internal/devexp/minions/service/history"
 	"code.uber.internal/devexp/minions/service/matching"
+	"github.com/opentracing/opentracing-go"
 	"github.com/uber-common/bark"
 	"github.com/uber-go/tally"
 	tchannel "github.com/uber/tchannel-go"
 	"github.com/uber/tchannel-go/thrift"
+	"golang.org/x/sync/errgroup"
+)
+
+// tracerCloseTimeout bounds how long Stop() waits for a tracer's reporter to
+// flush and close before giving up.
+const tracerCloseTimeout = 5 * time.Second
+
+// defaultRingpopReadyTimeout bounds how long Start() waits for the ringpop
+// ring to include all three hosted services when no explicit timeout is
+// configured.
+const defaultRingpopReadyTimeout = 30 * time.Second
+
+const (
+	frontendServiceName = "cadence-frontend"
+	historyServiceName  = "cadence-history"
+	matchingServiceName = "cadence-matching"
 )
 
 // Cadence hosts all of cadence services in one process
 type Cadence interface {
-	Start() error
+	Start(ctx context.Context) error
+	// Shutdown stops the frontend first, then matching, then history (the
+	// reverse of start order) so in-flight requests can drain, and returns
+	// once every service has stopped or ctx's deadline passes, whichever
+	// comes first.
+	Shutdown(ctx context.Context) error
 	Stop()
+	// InstallSignalHandler wires SIGINT/SIGTERM to Shutdown, giving it
+	// gracePeriod to drain before forcing a return.
+	InstallSignalHandler(gracePeriod time.Duration)
 	FrontendAddress() string
 	MatchingServiceAddress() string
 	HistoryServiceAddress() string
@@ -33,126 +64,362 @@ type cadenceImpl struct {
 	shardMgr              persistence.ShardManager
 	taskMgr               persistence.TaskManager
 	executionMgrFactory   persistence.ExecutionManagerFactory
-	shutdownCh            chan struct{}
-	shutdownWG            sync.WaitGroup
+	tracer                opentracing.Tracer
+	metricsOptions        MetricsOptions
+	metricsScope          tally.Scope
+	metricsCloser         io.Closer
+	ringpopReadyTimeout   time.Duration
+
+	cancel   context.CancelFunc
+	errGroup *errgroup.Group
+
+	frontendListenAddress string
+	historyListenAddress  string
+	matchingListenAddress string
+
+	frontendChannel *tchannel.Channel
+	historyChannel  *tchannel.Channel
+	matchingChannel *tchannel.Channel
 }
 
-// NewCadence returns an instance that hosts full cadence in one process
+// NewCadence returns an instance that hosts full cadence in one process.
+// frontendAddress, historyAddress and matchingAddress are the addresses each
+// service listens on; passing ":0" for any of them lets the OS pick a free
+// port, with the actual bound address available afterwards through
+// FrontendAddress, HistoryServiceAddress and MatchingServiceAddress. tracer
+// is set on each service's tchannel.Channel (see listenTChannel), so tchannel
+// itself starts a span for every outbound frontend->history/matching call,
+// injects it into that call, and extracts/continues it on the receiving
+// channel; a nil tracer disables tracing. metricsOptions configures how each
+// service reports metrics; see MetricsOptions for its defaults.
+// ringpopReadyTimeout bounds how long Start() waits for the ringpop ring to
+// converge before failing; zero or negative uses defaultRingpopReadyTimeout.
 func NewCadence(shardMgr persistence.ShardManager, executionMgrFactory persistence.ExecutionManagerFactory,
-	taskMgr persistence.TaskManager, numberOfHistoryShards int, logger bark.Logger) Cadence {
+	taskMgr persistence.TaskManager, numberOfHistoryShards int, logger bark.Logger,
+	frontendAddress, historyAddress, matchingAddress string, tracer opentracing.Tracer,
+	metricsOptions MetricsOptions, ringpopReadyTimeout time.Duration) Cadence {
 	return &cadenceImpl{
 		numberOfHistoryShards: numberOfHistoryShards,
 		logger:                logger,
 		shardMgr:              shardMgr,
 		taskMgr:               taskMgr,
 		executionMgrFactory:   executionMgrFactory,
-		shutdownCh:            make(chan struct{}),
+		tracer:                defaultTracer(tracer),
+		metricsOptions:        metricsOptions,
+		frontendListenAddress: frontendAddress,
+		historyListenAddress:  historyAddress,
+		matchingListenAddress: matchingAddress,
+		ringpopReadyTimeout:   ringpopReadyTimeout,
 	}
 }
 
-func (c *cadenceImpl) Start() error {
+// defaultTracer guards every call site against a nil tracer by falling back
+// to a no-op implementation.
+func defaultTracer(tracer opentracing.Tracer) opentracing.Tracer {
+	if tracer == nil {
+		return opentracing.NoopTracer{}
+	}
+	return tracer
+}
+
+// Start binds all three services and blocks until their ringpop ring has
+// converged, returning an error if it has not converged within the ringpop
+// ready timeout. Cancelling ctx stops the sub-services; a wait for the ring
+// that is already under way is not ended by it and returns the timeout error
+// once the timeout elapses. Otherwise the returned error is the first startup
+// failure encountered by any sub-service.
+func (c *cadenceImpl) Start(ctx context.Context) error {
+	var err error
+	if c.frontendChannel, err = listenTChannel(frontendServiceName, c.frontendListenAddress, c.tracer); err != nil {
+		return err
+	}
+	if c.historyChannel, err = listenTChannel(historyServiceName, c.historyListenAddress, c.tracer); err != nil {
+		return err
+	}
+	if c.matchingChannel, err = listenTChannel(matchingServiceName, c.matchingListenAddress, c.tracer); err != nil {
+		return err
+	}
+
 	var rpHosts []string
 	rpHosts = append(rpHosts, c.FrontendAddress())
 	rpHosts = append(rpHosts, c.MatchingServiceAddress())
 	rpHosts = append(rpHosts, c.HistoryServiceAddress())
 
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	g, gctx := errgroup.WithContext(ctx)
+	c.errGroup = g
+	go func() {
+		if err := g.Wait(); err != nil {
+			c.logger.WithField("error", err).Error("cadence service exited with error")
+		}
+	}()
+
+	c.metricsScope, c.metricsCloser = buildMetricsScope(ctx, c.metricsOptions, c.logger)
+
+	readyCh := make(chan struct{}, 3)
+
 	var startWG sync.WaitGroup
 	startWG.Add(2)
-	go c.startHistory(c.logger, c.shardMgr, c.executionMgrFactory, rpHosts, &startWG)
-	go c.startMatching(c.logger, c.taskMgr, rpHosts, &startWG)
+	g.Go(func() error {
+		return c.startHistory(gctx, c.logger, c.shardMgr, c.executionMgrFactory, rpHosts, &startWG, readyCh)
+	})
+	g.Go(func() error {
+		return c.startMatching(gctx, c.logger, c.taskMgr, rpHosts, &startWG, readyCh)
+	})
 	startWG.Wait()
+	if gctx.Err() != nil {
+		return g.Wait()
+	}
 
 	startWG.Add(1)
-	go c.startFrontend(c.logger, rpHosts, &startWG)
+	g.Go(func() error {
+		return c.startFrontend(gctx, c.logger, rpHosts, &startWG, readyCh)
+	})
 	startWG.Wait()
-	// Allow some time for the ring to stabilize
-	// TODO: remove this after adding automatic retries on transient errors in clients
-	time.Sleep(time.Second * 5)
+	if gctx.Err() != nil {
+		return g.Wait()
+	}
+
+	if err := waitForRingpopReady(readyCh, 3, c.ringpopReadyTimeout); err != nil {
+		cancel()
+		return err
+	}
 	return nil
 }
 
-func (c *cadenceImpl) Stop() {
-	c.shutdownWG.Add(3)
+// waitForRingpopReady blocks until expected signals have been received on
+// readyCh, or returns an error once timeout elapses without the ring
+// converging. A timeout <= 0 uses defaultRingpopReadyTimeout.
+func waitForRingpopReady(readyCh <-chan struct{}, expected int, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultRingpopReadyTimeout
+	}
+	timeoutCh := time.After(timeout)
+	for i := 0; i < expected; i++ {
+		select {
+		case <-readyCh:
+		case <-timeoutCh:
+			return errors.New("timed out waiting for ringpop ring to stabilize")
+		}
+	}
+	return nil
+}
+
+// Shutdown stops the frontend first so no new requests are accepted, then
+// matching, then history, cancels the sub-services' context so in-flight
+// requests can drain and their tchannels close, and waits for that to finish
+// up to ctx's deadline.
+func (c *cadenceImpl) Shutdown(ctx context.Context) error {
 	c.frontendHandler.Stop()
-	c.historyHandler.Stop()
 	c.matchingHandler.Stop()
-	close(c.shutdownCh)
-	c.shutdownWG.Wait()
+	c.historyHandler.Stop()
+	c.cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- c.errGroup.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	closeTracer(c.tracer, c.logger)
+	if mErr := c.metricsCloser.Close(); mErr != nil {
+		c.logger.WithField("error", mErr).Warn("failed to close metrics reporter")
+	}
+	return err
+}
+
+// Stop shuts the host down with no deadline. Use Shutdown directly for
+// bounded draining.
+func (c *cadenceImpl) Stop() {
+	if err := c.Shutdown(context.Background()); err != nil {
+		c.logger.WithField("error", err).Error("error during shutdown")
+	}
+}
+
+// InstallSignalHandler wires SIGINT/SIGTERM to Shutdown, giving gracePeriod
+// to drain in-flight requests before forcing a return. It is meant to be
+// called once, typically right after Start.
+func (c *cadenceImpl) InstallSignalHandler(gracePeriod time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		c.logger.WithField("signal", sig).Info("received shutdown signal")
+		ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+		if err := c.Shutdown(ctx); err != nil {
+			c.logger.WithField("error", err).Error("graceful shutdown did not complete within grace period")
+		}
+	}()
 }
 
 func (c *cadenceImpl) FrontendAddress() string {
-	return "127.0.0.1:7104"
+	return c.frontendChannel.PeerInfo().HostPort
 }
 
 func (c *cadenceImpl) HistoryServiceAddress() string {
-	return "127.0.0.1:7105"
+	return c.historyChannel.PeerInfo().HostPort
 }
 
 func (c *cadenceImpl) MatchingServiceAddress() string {
-	return "127.0.0.1:7106"
+	return c.matchingChannel.PeerInfo().HostPort
 }
 
-func (c *cadenceImpl) startFrontend(logger bark.Logger, rpHosts []string, startWG *sync.WaitGroup) {
+func (c *cadenceImpl) startFrontend(ctx context.Context, logger bark.Logger, rpHosts []string,
+	startWG *sync.WaitGroup, readyCh chan struct{}) error {
 	tchanFactory := func(sName string, thriftServices []thrift.TChanServer) (*tchannel.Channel, *thrift.Server) {
-		return c.createTChannel(sName, c.FrontendAddress(), thriftServices)
+		return attachThriftServices(c.frontendChannel, thriftServices)
 	}
-	scope := tally.NewTestScope("cadence-frontend", make(map[string]string))
-	service := service.New("cadence-frontend", logger, scope, tchanFactory, rpHosts, c.numberOfHistoryShards)
+	scope := scopeForService(c.metricsScope, frontendServiceName)
+	svc := service.New(frontendServiceName, logger.WithField("service", frontendServiceName), scope, tchanFactory,
+		rpHosts, c.numberOfHistoryShards, c.tracer)
+	go notifyOnRingpopReady(ctx, svc.GetRingpop().GetReachableMembers, rpHosts, readyCh)
 	var thriftServices []thrift.TChanServer
-	c.frontendHandler, thriftServices = frontend.NewWorkflowHandler(service)
-	err := c.frontendHandler.Start(thriftServices)
-	if err != nil {
-		c.logger.WithField("error", err).Fatal("Failed to start frontend")
+	c.frontendHandler, thriftServices = frontend.NewWorkflowHandler(svc)
+	if err := c.frontendHandler.Start(thriftServices); err != nil {
+		c.cancel()
+		startWG.Done()
+		return err
 	}
 	startWG.Done()
-	<-c.shutdownCh
-	c.shutdownWG.Done()
+	<-ctx.Done()
+	return c.frontendChannel.Close()
 }
 
-func (c *cadenceImpl) startHistory(logger bark.Logger, shardMgr persistence.ShardManager,
-	executionMgrFactory persistence.ExecutionManagerFactory, rpHosts []string, startWG *sync.WaitGroup) {
+func (c *cadenceImpl) startHistory(ctx context.Context, logger bark.Logger, shardMgr persistence.ShardManager,
+	executionMgrFactory persistence.ExecutionManagerFactory, rpHosts []string, startWG *sync.WaitGroup,
+	readyCh chan struct{}) error {
 	tchanFactory := func(sName string, thriftServices []thrift.TChanServer) (*tchannel.Channel, *thrift.Server) {
-		return c.createTChannel(sName, c.HistoryServiceAddress(), thriftServices)
+		return attachThriftServices(c.historyChannel, thriftServices)
 	}
-	scope := tally.NewTestScope("cadence-history", make(map[string]string))
-	service := service.New("cadence-history", logger, scope, tchanFactory, rpHosts, c.numberOfHistoryShards)
+	scope := scopeForService(c.metricsScope, historyServiceName)
+	svc := service.New(historyServiceName, logger.WithField("service", historyServiceName), scope, tchanFactory,
+		rpHosts, c.numberOfHistoryShards, c.tracer)
+	go notifyOnRingpopReady(ctx, svc.GetRingpop().GetReachableMembers, rpHosts, readyCh)
 	var thriftServices []thrift.TChanServer
-	c.historyHandler, thriftServices = history.NewHandler(service, shardMgr, executionMgrFactory, c.numberOfHistoryShards, false)
+	c.historyHandler, thriftServices = history.NewHandler(svc, shardMgr, executionMgrFactory, c.numberOfHistoryShards, false)
 	c.historyHandler.Start(thriftServices)
 	startWG.Done()
-	<-c.shutdownCh
-	c.shutdownWG.Done()
+	<-ctx.Done()
+	return c.historyChannel.Close()
 }
 
-func (c *cadenceImpl) startMatching(logger bark.Logger, taskMgr persistence.TaskManager,
-	rpHosts []string, startWG *sync.WaitGroup) {
+func (c *cadenceImpl) startMatching(ctx context.Context, logger bark.Logger, taskMgr persistence.TaskManager,
+	rpHosts []string, startWG *sync.WaitGroup, readyCh chan struct{}) error {
 	tchanFactory := func(sName string, thriftServices []thrift.TChanServer) (*tchannel.Channel, *thrift.Server) {
-		return c.createTChannel(sName, c.MatchingServiceAddress(), thriftServices)
+		return attachThriftServices(c.matchingChannel, thriftServices)
 	}
-	scope := tally.NewTestScope("cadence-matching", make(map[string]string))
-	service := service.New("cadence-matching", logger, scope, tchanFactory, rpHosts, c.numberOfHistoryShards)
+	scope := scopeForService(c.metricsScope, matchingServiceName)
+	svc := service.New(matchingServiceName, logger.WithField("service", matchingServiceName), scope, tchanFactory,
+		rpHosts, c.numberOfHistoryShards, c.tracer)
+	go notifyOnRingpopReady(ctx, svc.GetRingpop().GetReachableMembers, rpHosts, readyCh)
 	var thriftServices []thrift.TChanServer
-	c.matchingHandler, thriftServices = matching.NewHandler(taskMgr, service)
+	c.matchingHandler, thriftServices = matching.NewHandler(taskMgr, svc)
 	c.matchingHandler.Start(thriftServices)
 	startWG.Done()
-	<-c.shutdownCh
-	c.shutdownWG.Done()
+	<-ctx.Done()
+	return c.matchingChannel.Close()
 }
 
-func (c *cadenceImpl) createTChannel(sName string, hostPort string,
-	thriftServices []thrift.TChanServer) (*tchannel.Channel, *thrift.Server) {
-	ch, err := tchannel.NewChannel(sName, nil)
+// getReachableMembersFunc reports the set of ringpop members currently
+// reachable from a service, typically svc.GetRingpop().GetReachableMembers.
+type getReachableMembersFunc func() ([]string, error)
+
+// notifyOnRingpopReady polls getMembers and sends on readyCh as soon as every
+// host in rpHosts is reachable; readyCh must be buffered deeply enough that
+// this never blocks. It gives up and returns without sending once ctx is
+// cancelled, so a caller that stops waiting (Start timing out or being
+// cancelled before the ring converges) doesn't leak this goroutine forever.
+func notifyOnRingpopReady(ctx context.Context, getMembers getReachableMembersFunc, rpHosts []string, readyCh chan<- struct{}) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			members, err := getMembers()
+			if err != nil {
+				continue
+			}
+			if containsAll(members, rpHosts) {
+				readyCh <- struct{}{}
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func containsAll(members []string, hosts []string) bool {
+	set := make(map[string]struct{}, len(members))
+	for _, m := range members {
+		set[m] = struct{}{}
+	}
+	for _, h := range hosts {
+		if _, ok := set[h]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// listenTChannel creates a tchannel.Channel for sName and binds it to
+// hostPort, returning the channel with its actual bound address available via
+// PeerInfo().HostPort (useful when hostPort is ":0"). tracer is wired into
+// the channel's ChannelOptions so tchannel itself starts a span for every
+// outbound call, injects it into the call's tracing fields, and
+// extracts/continues it on the receiving channel's inbound call — this is
+// the actual span propagation across the frontend/history/matching RPC
+// boundary; callers don't need to start or inject spans themselves. A nil
+// tracer disables tracing for the channel.
+func listenTChannel(sName string, hostPort string, tracer opentracing.Tracer) (*tchannel.Channel, error) {
+	ch, err := tchannel.NewChannel(sName, &tchannel.ChannelOptions{Tracer: tracer})
 	if err != nil {
-		c.logger.WithField("error", err).Fatal("Failed to create TChannel")
+		return nil, err
+	}
+	if err := ch.ListenAndServe(hostPort); err != nil {
+		return nil, err
 	}
+	return ch, nil
+}
+
+func attachThriftServices(ch *tchannel.Channel,
+	thriftServices []thrift.TChanServer) (*tchannel.Channel, *thrift.Server) {
 	server := thrift.NewServer(ch)
 	for _, thriftService := range thriftServices {
 		server.Register(thriftService)
 	}
+	return ch, server
+}
 
-	err = ch.ListenAndServe(hostPort)
-	if err != nil {
-		c.logger.WithField("error", err).Fatal("Failed to listen on tchannel")
+// closeTracer flushes and closes tracer if it supports io.Closer, bounding
+// the wait by tracerCloseTimeout and recovering from any panic in the
+// reporter so a misbehaving tracer can never block or crash shutdown.
+func closeTracer(tracer opentracing.Tracer, logger bark.Logger) {
+	closer, ok := tracer.(io.Closer)
+	if !ok {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				logger.WithField("error", r).Error("panic while closing tracer")
+			}
+		}()
+		if err := closer.Close(); err != nil {
+			logger.WithField("error", err).Warn("failed to close tracer")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(tracerCloseTimeout):
+		logger.Warn("timed out waiting for tracer to close")
 	}
-	return ch, server
 }
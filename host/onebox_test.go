@@ -0,0 +1,77 @@
+package host
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/uber-go/tally"
+)
+
+// TestListenTChannel_WiresTracerIntoChannel asserts that the tracer passed to
+// listenTChannel ends up set on the resulting tchannel.Channel, which is what
+// makes tchannel start/inject/extract spans across the frontend->history and
+// frontend->matching calls (see listenTChannel's doc comment). A true
+// end-to-end test driving a real StartWorkflowExecution through frontend,
+// history and matching and asserting child spans on each isn't buildable in
+// this tree: the frontend/history/matching/persistence packages this process
+// depends on aren't vendored here, only referenced by import path.
+func TestListenTChannel_WiresTracerIntoChannel(t *testing.T) {
+	tracer := mocktracer.New()
+	ch, err := listenTChannel("test-service", ":0", tracer)
+	if err != nil {
+		t.Fatalf("listenTChannel failed: %v", err)
+	}
+	defer ch.Close()
+
+	if got := ch.Tracer(); got != tracer {
+		t.Fatalf("channel tracer = %v, want %v", got, tracer)
+	}
+}
+
+// goroutineDelta runs fn and returns how many more goroutines are running
+// once it returns than were running before, after a brief settle delay to let
+// goroutines that exit promptly actually finish.
+func goroutineDelta(fn func()) int {
+	before := runtime.NumGoroutine()
+	fn()
+	time.Sleep(50 * time.Millisecond)
+	return runtime.NumGoroutine() - before
+}
+
+// TestNotifyOnRingpopReady_NoGoroutineLeakAfterCancel verifies that
+// notifyOnRingpopReady, started as its own goroutine by each of
+// startFrontend/startHistory/startMatching/runFrontend/runHistoryNode/
+// runMatchingNode, exits once its context is cancelled instead of polling
+// forever.
+func TestNotifyOnRingpopReady_NoGoroutineLeakAfterCancel(t *testing.T) {
+	delta := goroutineDelta(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		getMembers := func() ([]string, error) { return nil, nil }
+		readyCh := make(chan struct{}, 1)
+		go notifyOnRingpopReady(ctx, getMembers, []string{"never-reachable"}, readyCh)
+		cancel()
+		time.Sleep(150 * time.Millisecond)
+	})
+	if delta > 0 {
+		t.Fatalf("notifyOnRingpopReady leaked %d goroutine(s) past context cancellation", delta)
+	}
+}
+
+// TestReportRuntimeMetrics_NoGoroutineLeakAfterCancel verifies that the
+// goroutine reportRuntimeMetrics starts to sample runtime gauges exits once
+// its context is cancelled instead of ticking forever.
+func TestReportRuntimeMetrics_NoGoroutineLeakAfterCancel(t *testing.T) {
+	delta := goroutineDelta(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		reportRuntimeMetrics(ctx, tally.NoopScope, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+	})
+	if delta > 0 {
+		t.Fatalf("reportRuntimeMetrics leaked %d goroutine(s) past context cancellation", delta)
+	}
+}